@@ -8,15 +8,27 @@ package types
 
 import "go/ast"
 
-// TODO(gri) The named type consolidation and seen maps below must be
-//           indexed by unique keys for a given type. Verify that named
-//           types always have only one representation (even when imported
-//           indirectly via different packages.)
-
 // LookupFieldOrMethod looks up a field or method with given package and name
 // in typ and returns the corresponding *Field or *Func, an index sequence,
 // and a bool indicating if there were any pointer indirections on the path
-// to the field or method.
+// to the field or method. It is a thin wrapper around lookupFieldOrMethod
+// for callers with no addressable value to report; see that function for
+// the full contract, including how addressable affects promoted
+// pointer-receiver methods and how a miss is classified.
+func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index []int, indirect bool) {
+	return lookupFieldOrMethod(typ, false, pkg, name)
+}
+
+// lookupFieldOrMethod looks up a field or method with given package and
+// name in typ and returns the corresponding *Field or *Func, an index
+// sequence, and a bool indicating if there were any pointer indirections
+// on the path to the field or method.
+//
+// addressable reports whether typ is the type of an addressable value,
+// which affects whether a method with a pointer receiver is considered
+// part of the method set: such a method is only found if addressable is
+// true or if an indirection occurred somewhere along the embedding chain
+// leading to it.
 //
 // The last index entry is the field or method index in the (possibly embedded)
 // type where the entry was found, either:
@@ -28,10 +40,19 @@ import "go/ast"
 // The earlier index entries are the indices of the embedded fields traversed
 // to get to the found entry, starting at depth 0.
 //
-// If no entry is found, a nil object is returned. In this case, the returned
-// index sequence points to an ambiguous entry if it exists, or it is nil.
+// If no entry is found, a nil object is returned, and the remaining
+// results classify the miss (see MethodSetError):
 //
-func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index []int, indirect bool) {
+//	index != nil             the search collided on two or more entries
+//	                          at the same depth; index points to one of
+//	                          the colliding entries
+//	index == nil && indirect  name resolved to a method with a pointer
+//	                          receiver that is not in the method set
+//	                          reached (addressable was false and no
+//	                          indirection occurred along the way)
+//	index == nil && !indirect name does not exist
+//
+func lookupFieldOrMethod(typ Type, addressable bool, pkg *Package, name string) (obj Object, index []int, indirect bool) {
 	if name == "_" {
 		return // empty fields/methods are never found
 	}
@@ -40,10 +61,21 @@ func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index
 	// If typ is not a named type, insert a nil type instead.
 	typ, isPtr := deref(typ)
 	t, _ := typ.(*Named)
-	current := []embeddedType{{t, nil, isPtr, false}}
+	var t0 Type
+	if t != nil {
+		t0 = t
+	}
+	current := []embeddedType{{t0, nil, isPtr, false}}
 
-	// named types that we have seen already
-	seen := make(map[*Named]bool)
+	// set once an attached method with a pointer receiver is found
+	// that is not in the method set reached so far (see wrongIndirect below)
+	wrongIndirect := false
+
+	// types that we have seen already, compared by identity rather
+	// than pointer equality: the same logical type may be reached
+	// through more than one *Named value (e.g. imported along
+	// different paths, or distinct instantiations of a generic type).
+	var seen []Type
 
 	// search current depth
 	for len(current) > 0 {
@@ -55,7 +87,7 @@ func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index
 			// In this case, we don't have a named type and
 			// we simply continue with the underlying type.
 			if e.typ != nil {
-				if seen[e.typ] {
+				if indexIdentical(seen, e.typ) >= 0 {
 					// We have seen this type before, at a more shallow depth
 					// (note that multiples of this type at the current depth
 					// were eliminated before). The type at that depth shadows
@@ -63,12 +95,24 @@ func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index
 					// this one.
 					continue
 				}
-				seen[e.typ] = true
+				seen = append(seen, e.typ)
+
+				named := e.typ.(*Named)
 
 				// look for a matching attached method
-				if i, m := lookupMethod(e.typ.methods, pkg, name); m != nil {
+				if i, m := lookupMethod(named.methods, pkg, name); m != nil {
 					// potential match
 					assert(m.typ != nil)
+					if ptrRecv(m) && !(addressable || e.indirect) {
+						// m has a pointer receiver and is not reachable
+						// through an addressable value or an indirection
+						// on the path to it, so it is not in the method
+						// set we're searching; remember that we found the
+						// name anyway so the caller can distinguish this
+						// from the name not existing at all.
+						wrongIndirect = true
+						continue
+					}
 					index = concat(e.index, i)
 					if obj != nil || e.multiples {
 						obj = nil // collision
@@ -80,7 +124,7 @@ func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index
 				}
 
 				// continue with underlying type
-				typ = e.typ.underlying
+				typ = named.underlying
 			}
 
 			switch t := typ.(type) {
@@ -139,17 +183,45 @@ func LookupFieldOrMethod(typ Type, pkg *Package, name string) (obj Object, index
 		current = consolidateMultiples(next)
 	}
 
+	if wrongIndirect {
+		// the name exists but names a pointer-receiver method
+		// not in the method set we searched
+		return nil, nil, true
+	}
 	index = nil
 	indirect = false
 	return // not found
 }
 
+// ptrRecv reports whether the method m has a pointer receiver.
+func ptrRecv(m *Func) bool {
+	sig, _ := m.typ.(*Signature)
+	if sig == nil || sig.recv == nil {
+		return false
+	}
+	_, isPtr := deref(sig.recv.typ)
+	return isPtr
+}
+
 // embeddedType represents an embedded named type
 type embeddedType struct {
-	typ       *Named // nil means use the outer typ variable instead
-	index     []int  // embedded field indices, starting with index at depth 0
-	indirect  bool   // if set, there was a pointer indirection on the path to this field
-	multiples bool   // if set, typ appears multiple times at this depth
+	typ       Type  // nil means use the outer typ variable instead; always a *Named otherwise
+	index     []int // embedded field indices, starting with index at depth 0
+	indirect  bool  // if set, there was a pointer indirection on the path to this field
+	multiples bool  // if set, typ appears multiple times at this depth
+}
+
+// indexIdentical returns the index of the first type in types that is
+// identical to typ, or -1 if there is none. Identity, not pointer
+// equality, is used for the comparison so that distinct *Named values
+// representing the same type are recognized as duplicates.
+func indexIdentical(types []Type, typ Type) int {
+	for i, t := range types {
+		if IsIdentical(t, typ) {
+			return i
+		}
+	}
+	return -1
 }
 
 // consolidateMultiples collects multiple list entries with the same type
@@ -160,14 +232,14 @@ func consolidateMultiples(list []embeddedType) []embeddedType {
 		return list // at most one entry - nothing to do
 	}
 
-	n := 0                       // number of entries w/ unique type
-	prev := make(map[*Named]int) // index at which type was previously seen
+	n := 0          // number of entries w/ unique type
+	var prev []Type // types already stored in list[:n], by identity
 	for _, e := range list {
-		if i, found := prev[e.typ]; found {
+		if i := indexIdentical(prev, e.typ); i >= 0 {
 			list[i].multiples = true
 			// ignore this entry
 		} else {
-			prev[e.typ] = n
+			prev = append(prev, e.typ)
 			list[n] = e
 			n++
 		}
@@ -175,11 +247,45 @@ func consolidateMultiples(list []embeddedType) []embeddedType {
 	return list[:n]
 }
 
+// A MethodSetError classifies why a LookupFieldOrMethod call returned
+// a nil object, as reported by ClassifyMiss.
+type MethodSetError int
+
+const (
+	// ErrNotFound means the name does not exist at all.
+	ErrNotFound MethodSetError = iota
+	// ErrAmbiguous means the search collided on two or more entries
+	// at the same embedding depth; the accompanying index identifies
+	// one of them.
+	ErrAmbiguous
+	// ErrWrongIndirection means the name resolved to a method with a
+	// pointer receiver that is not in the method set that was searched.
+	ErrWrongIndirection
+)
+
+// ClassifyMiss classifies a (index, indirect) result pair returned by
+// LookupFieldOrMethod alongside a nil object, so that callers can report
+// a meaningful diagnostic instead of a bare "not found".
+func ClassifyMiss(index []int, indirect bool) MethodSetError {
+	switch {
+	case index != nil:
+		return ErrAmbiguous
+	case indirect:
+		return ErrWrongIndirection
+	default:
+		return ErrNotFound
+	}
+}
+
 // MissingMethod returns (nil, false) if typ implements T, otherwise
 // it returns the first missing method required by T and whether it
-// is missing or simply has the wrong type.
+// is missing or simply has the wrong type. addressable reports whether
+// typ is the type of an addressable value (e.g. a variable, rather
+// than a map value or a function result) and is passed on to
+// lookupFieldOrMethod so that promoted pointer-receiver methods are
+// credited to typ's method set exactly when the language spec allows it.
 //
-func MissingMethod(typ Type, T *Interface) (method *Func, wrongType bool) {
+func MissingMethod(typ Type, T *Interface, addressable bool) (method *Func, wrongType bool) {
 	// an interface type implements T if it has no methods with conflicting signatures
 	// Note: This is stronger than the current spec. Should the spec require this?
 
@@ -203,8 +309,11 @@ func MissingMethod(typ Type, T *Interface) (method *Func, wrongType bool) {
 	}
 
 	// A concrete type implements T if it implements all methods of T.
+	// lookupFieldOrMethod already applies the addressable/indirection
+	// rules for promoted pointer-receiver methods, so a method it
+	// returns is by construction in the method set we're checking.
 	for _, m := range T.methods {
-		obj, _, indirect := LookupFieldOrMethod(typ, m.pkg, m.name)
+		obj, _, _ := lookupFieldOrMethod(typ, addressable, m.pkg, m.name)
 		if obj == nil {
 			return m, false
 		}
@@ -214,14 +323,6 @@ func MissingMethod(typ Type, T *Interface) (method *Func, wrongType bool) {
 			return m, false
 		}
 
-		// verify that f is in the method set of typ
-		// (the receiver is nil if f is an interface method)
-		if recv := f.typ.(*Signature).recv; recv != nil {
-			if _, isPtr := deref(recv.typ); isPtr && !indirect {
-				return m, false
-			}
-		}
-
 		if !IsIdentical(obj.Type(), m.typ) {
 			return m, true
 		}
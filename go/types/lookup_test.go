@@ -0,0 +1,247 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package types
+
+import (
+	"go/token"
+	"testing"
+	"time"
+)
+
+// newTestNamed returns a new defined type named "name" with the given
+// underlying type and methods, declared in pkg.
+func newTestNamed(pkg *Package, name string, underlying Type, methods ...*Func) *Named {
+	obj := NewTypeName(token.NoPos, pkg, name, nil)
+	return NewNamed(obj, underlying, methods)
+}
+
+func newTestField(pkg *Package, name string, typ Type, anonymous bool) *Var {
+	return NewField(token.NoPos, pkg, name, typ, anonymous)
+}
+
+// newTestMethod returns a new method named "M" with no parameters or
+// results, declared with a receiver of type recvType.
+func newTestMethod(pkg *Package, recvType Type) *Func {
+	recv := NewVar(token.NoPos, pkg, "", recvType)
+	sig := NewSignature(recv, nil, nil, false)
+	return NewFunc(token.NoPos, pkg, "M", sig)
+}
+
+// TestLookupFieldOrMethodIdenticalEmbeddedTypesCollide covers scenario
+// (a): the same defined type reached via two embedded fields that are
+// pointer-different but identical (as can happen when a type is
+// imported along two different paths). Field X is reached through both
+// at the same depth, so the lookup must report it as ambiguous.
+func TestLookupFieldOrMethodIdenticalEmbeddedTypesCollide(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	// Base is reached through Left and Right via two distinct *Named
+	// values that share the same *TypeName and so are identical.
+	baseField := newTestField(pkg, "X", Typ[Int], false)
+	baseName := NewTypeName(token.NoPos, pkg, "Base", nil)
+	baseUnderlying := NewStruct([]*Var{baseField}, nil)
+	base1 := NewNamed(baseName, baseUnderlying, nil)
+	base2 := NewNamed(baseName, baseUnderlying, nil)
+	if base1 == base2 {
+		t.Fatal("test requires two distinct *Named values")
+	}
+	if !IsIdentical(base1, base2) {
+		t.Fatal("test requires identical *Named values")
+	}
+
+	left := newTestNamed(pkg, "Left", NewStruct([]*Var{newTestField(pkg, "Base", base1, true)}, nil))
+	right := newTestNamed(pkg, "Right", NewStruct([]*Var{newTestField(pkg, "Base", base2, true)}, nil))
+	diamond := NewStruct([]*Var{
+		newTestField(pkg, "Left", left, true),
+		newTestField(pkg, "Right", right, true),
+	}, nil)
+
+	obj, index, indirect := LookupFieldOrMethod(diamond, pkg, "X")
+	if obj != nil {
+		t.Fatalf("X = %v, want ambiguous (nil)", obj)
+	}
+	if ClassifyMiss(index, indirect) != ErrAmbiguous {
+		t.Fatalf("ClassifyMiss(%v, %v) = %v, want ErrAmbiguous", index, indirect, ClassifyMiss(index, indirect))
+	}
+}
+
+// TestLookupFieldOrMethodRecursiveIdenticalTypesTerminates covers
+// scenario (b): a recursive type reached through alternating,
+// pointer-distinct *Named values that are nonetheless identical. The
+// lookup must recognize node2 as already seen and stop.
+func TestLookupFieldOrMethodRecursiveIdenticalTypesTerminates(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	tname := NewTypeName(token.NoPos, pkg, "Node", nil)
+	node1 := NewNamed(tname, nil, nil)
+	node2 := NewNamed(tname, nil, nil)
+	if node1 == node2 {
+		t.Fatal("test requires two distinct *Named values")
+	}
+
+	// node1 embeds *node2 and node2 embeds *node1: the same logical
+	// type, reached through a different *Named value at every other
+	// depth.
+	node1.SetUnderlying(NewStruct([]*Var{newTestField(pkg, "Node", NewPointer(node2), true)}, nil))
+	node2.SetUnderlying(NewStruct([]*Var{newTestField(pkg, "Node", NewPointer(node1), true)}, nil))
+
+	done := make(chan struct{})
+	go func() {
+		LookupFieldOrMethod(node1, pkg, "NoSuchField")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("LookupFieldOrMethod did not terminate on a recursive type")
+	}
+}
+
+// TestLookupFieldOrMethodShadowedFieldsDoNotCollide verifies that a
+// field shadowed by another field at a shallower embedding depth is
+// never reported as an ambiguous collision: the shallower field wins
+// outright, and ClassifyMiss is never reached because a match is found.
+func TestLookupFieldOrMethodShadowedFieldsDoNotCollide(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	// inner.X is shadowed by outer's own X field at depth 0.
+	inner := newTestNamed(pkg, "Inner", NewStruct([]*Var{newTestField(pkg, "X", Typ[Int], false)}, nil))
+	outer := NewStruct([]*Var{
+		newTestField(pkg, "X", Typ[String], false),
+		newTestField(pkg, "Inner", inner, true),
+	}, nil)
+
+	obj, index, indirect := LookupFieldOrMethod(outer, pkg, "X")
+	if obj == nil {
+		t.Fatalf("X not found, want the depth-0 field; ClassifyMiss = %v", ClassifyMiss(index, indirect))
+	}
+	if len(index) != 1 || index[0] != 0 {
+		t.Fatalf("index = %v, want [0] (the outer field)", index)
+	}
+}
+
+// TestLookupFieldOrMethodAmbiguousIndexAtEqualDepth verifies that two
+// distinct fields with the same name at the same embedding depth are
+// reported via ClassifyMiss as ErrAmbiguous, with a non-nil index
+// pointing at one of the colliding entries.
+func TestLookupFieldOrMethodAmbiguousIndexAtEqualDepth(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	left := newTestNamed(pkg, "Left", NewStruct([]*Var{newTestField(pkg, "X", Typ[Int], false)}, nil))
+	right := newTestNamed(pkg, "Right", NewStruct([]*Var{newTestField(pkg, "X", Typ[Int], false)}, nil))
+	outer := NewStruct([]*Var{
+		newTestField(pkg, "Left", left, true),
+		newTestField(pkg, "Right", right, true),
+	}, nil)
+
+	obj, index, indirect := LookupFieldOrMethod(outer, pkg, "X")
+	if obj != nil {
+		t.Fatalf("X = %v, want ambiguous (nil)", obj)
+	}
+	if got := ClassifyMiss(index, indirect); got != ErrAmbiguous {
+		t.Fatalf("ClassifyMiss(%v, %v) = %v, want ErrAmbiguous", index, indirect, got)
+	}
+	if index == nil {
+		t.Fatal("index = nil, want a non-nil index identifying a colliding entry")
+	}
+}
+
+// TestLookupFieldOrMethodDistinctTypesCollide covers scenario (c):
+// collision detection must still report ambiguity correctly for two
+// genuinely distinct embedded types that both declare the same name,
+// which has nothing to do with identity-based deduplication.
+func TestLookupFieldOrMethodDistinctTypesCollide(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	left := newTestNamed(pkg, "Left", NewStruct([]*Var{newTestField(pkg, "X", Typ[Int], false)}, nil))
+	right := newTestNamed(pkg, "Right", NewStruct([]*Var{newTestField(pkg, "X", Typ[String], false)}, nil))
+	outer := NewStruct([]*Var{
+		newTestField(pkg, "Left", left, true),
+		newTestField(pkg, "Right", right, true),
+	}, nil)
+
+	obj, index, indirect := LookupFieldOrMethod(outer, pkg, "X")
+	if obj != nil {
+		t.Fatalf("X = %v, want ambiguous (nil)", obj)
+	}
+	if ClassifyMiss(index, indirect) != ErrAmbiguous {
+		t.Fatalf("ClassifyMiss(%v, %v) = %v, want ErrAmbiguous", index, indirect, ClassifyMiss(index, indirect))
+	}
+}
+
+// TestMissingMethodAddressability exercises the addressable parameter
+// of MissingMethod for value embedding with a value receiver, value
+// embedding with a pointer receiver, and pointer embedding with a
+// pointer receiver, each with and without addressable. These cover
+// where a promoted pointer-receiver method is, or is not, considered
+// part of the method set; pointer embedding with a value receiver is
+// not tested.
+func TestMissingMethodAddressability(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	iface := NewInterface([]*Func{newTestMethod(pkg, nil)}, nil)
+	iface.Complete()
+
+	valueRecvInner := newTestNamed(pkg, "ValueInner", nil)
+	valueRecvInner.SetUnderlying(NewStruct(nil, nil))
+	valueRecvInner.methods = []*Func{newTestMethod(pkg, valueRecvInner)}
+
+	ptrRecvInner := newTestNamed(pkg, "PtrInner", nil)
+	ptrRecvInner.SetUnderlying(NewStruct(nil, nil))
+	ptrRecvInner.methods = []*Func{newTestMethod(pkg, NewPointer(ptrRecvInner))}
+
+	valueEmbedValueRecv := newTestNamed(pkg, "ValueEmbedValueRecv",
+		NewStruct([]*Var{newTestField(pkg, "ValueInner", valueRecvInner, true)}, nil))
+	valueEmbedPtrRecv := newTestNamed(pkg, "ValueEmbedPtrRecv",
+		NewStruct([]*Var{newTestField(pkg, "PtrInner", ptrRecvInner, true)}, nil))
+	ptrEmbedPtrRecv := newTestNamed(pkg, "PtrEmbedPtrRecv",
+		NewStruct([]*Var{newTestField(pkg, "PtrInner", NewPointer(ptrRecvInner), true)}, nil))
+
+	tests := []struct {
+		name        string
+		typ         Type
+		addressable bool
+		wantMissing bool
+	}{
+		{"value embed, value receiver, not addressable", valueEmbedValueRecv, false, false},
+		{"value embed, value receiver, addressable", valueEmbedValueRecv, true, false},
+		{"value embed, pointer receiver, not addressable", valueEmbedPtrRecv, false, true},
+		{"value embed, pointer receiver, addressable", valueEmbedPtrRecv, true, false},
+		{"pointer embed, pointer receiver, not addressable", ptrEmbedPtrRecv, false, false},
+		{"pointer embed, pointer receiver, addressable", ptrEmbedPtrRecv, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, wrongType := MissingMethod(test.typ, iface, test.addressable)
+			missing := method != nil && !wrongType
+			if missing != test.wantMissing {
+				t.Fatalf("MissingMethod(%s, addressable=%v) missing = %v, want %v (method=%v, wrongType=%v)",
+					test.typ, test.addressable, missing, test.wantMissing, method, wrongType)
+			}
+		})
+	}
+}
+
+// TestMissingMethodWrongType verifies that a method found with a
+// signature that differs from the interface's is reported via
+// wrongType, not as simply missing.
+func TestMissingMethodWrongType(t *testing.T) {
+	pkg := NewPackage("p", "p")
+
+	ifaceSig := NewSignature(nil, NewTuple(NewVar(token.NoPos, pkg, "", Typ[Int])), nil, false)
+	iface := NewInterface([]*Func{NewFunc(token.NoPos, pkg, "M", ifaceSig)}, nil)
+	iface.Complete()
+
+	implSig := NewSignature(nil, NewTuple(NewVar(token.NoPos, pkg, "", Typ[String])), nil, false)
+	impl := newTestNamed(pkg, "Impl", NewStruct(nil, nil), NewFunc(token.NoPos, pkg, "M", implSig))
+
+	method, wrongType := MissingMethod(impl, iface, true)
+	if method == nil {
+		t.Fatal("MissingMethod returned nil method, want the mismatched M")
+	}
+	if !wrongType {
+		t.Fatal("wrongType = false, want true for a method with a mismatched signature")
+	}
+}
@@ -8,7 +8,12 @@ package importgraph // import "github.com/Go-zh/tools/refactor/importgraph"
 
 import (
 	"go/build"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Go-zh/tools/go/buildutil"
 )
@@ -51,23 +56,259 @@ func (g Graph) Search(roots ...string) map[string]bool {
 	return seen
 }
 
-// Builds scans the specified Go workspace and builds the forward and
-// reverse import dependency graphs for all its packages.
-// It also returns a mapping from import paths to errors for packages
-// that could not be loaded.
-func Build(ctxt *build.Context) (forward, reverse Graph, errors map[string]error) {
-	type importEdge struct {
-		from, to string
+// SCC returns the strongly connected components of g, in reverse
+// topological order: if there is an edge from a node in component i
+// to a node in a different component j, then j occurs before i in
+// the result.
+//
+// The algorithm is Tarjan's; it is implemented iteratively, with an
+// explicit work stack of (node, child iterator) frames in place of
+// recursion, so that it does not blow the stack on large workspaces.
+func (g Graph) SCC() [][]string {
+	// Collect every node that appears either as a key or as a
+	// successor, since leaf and root packages need not be keys of g.
+	nodeSet := make(map[string]bool)
+	for from, edges := range g {
+		nodeSet[from] = true
+		for to := range edges {
+			nodeSet[to] = true
+		}
+	}
+	nodes := make([]string, 0, len(nodeSet))
+	for n := range nodeSet {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+
+	var (
+		index   = make(map[string]int)
+		lowlink = make(map[string]int)
+		onStack = make(map[string]bool)
+		stack   []string
+		next    int
+		comps   [][]string
+	)
+
+	// a frame records the progress of visiting one node's children
+	type frame struct {
+		node     string
+		children []string
+		i        int // index of the next child to visit
+	}
+
+	visit := func(node string) *frame {
+		index[node] = next
+		lowlink[node] = next
+		next++
+		stack = append(stack, node)
+		onStack[node] = true
+
+		children := make([]string, 0, len(g[node]))
+		for c := range g[node] {
+			children = append(children, c)
+		}
+		sort.Strings(children)
+		return &frame{node: node, children: children}
+	}
+
+	for _, root := range nodes {
+		if _, ok := index[root]; ok {
+			continue // already visited
+		}
+
+		work := []*frame{visit(root)}
+		for len(work) > 0 {
+			f := work[len(work)-1]
+
+			if f.i < len(f.children) {
+				c := f.children[f.i]
+				f.i++
+				if _, ok := index[c]; !ok {
+					work = append(work, visit(c))
+				} else if onStack[c] && lowlink[c] < lowlink[f.node] {
+					lowlink[f.node] = lowlink[c]
+				}
+				continue
+			}
+
+			// f's children have all been visited; pop it and
+			// propagate its lowlink to its parent, if any.
+			work = work[:len(work)-1]
+			if len(work) > 0 {
+				parent := work[len(work)-1]
+				if lowlink[f.node] < lowlink[parent.node] {
+					lowlink[parent.node] = lowlink[f.node]
+				}
+			}
+
+			if lowlink[f.node] == index[f.node] {
+				// f.node is the root of a component: pop it off
+				// the value stack.
+				var comp []string
+				for {
+					n := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					onStack[n] = false
+					comp = append(comp, n)
+					if n == f.node {
+						break
+					}
+				}
+				comps = append(comps, comp)
+			}
+		}
+	}
+
+	return comps
+}
+
+// Condensation returns the condensation of g: the DAG formed by
+// contracting each of g's strongly connected components to a single
+// node. Nodes of the returned graph are the decimal string form of a
+// component id, namely its index into the (reverse topologically
+// ordered) result of SCC; comp maps each node of g to the id of the
+// component that contains it.
+func (g Graph) Condensation() (cg Graph, comp map[string]int) {
+	sccs := g.SCC()
+
+	comp = make(map[string]int, len(sccs))
+	for id, scc := range sccs {
+		for _, n := range scc {
+			comp[n] = id
+		}
+	}
+
+	cg = make(Graph)
+	for from, edges := range g {
+		for to := range edges {
+			if cfrom, cto := comp[from], comp[to]; cfrom != cto {
+				cg.addEdge(strconv.Itoa(cfrom), strconv.Itoa(cto))
+			}
+		}
 	}
-	type pathError struct {
-		path string
-		err  error
+	return cg, comp
+}
+
+// Cycles returns the non-trivial strongly connected components of g:
+// those with more than one node, or a single node with a self-loop
+// (a package that imports itself, e.g. via a build-tag variant).
+// Each such component is an import cycle.
+func (g Graph) Cycles() [][]string {
+	var cycles [][]string
+	for _, scc := range g.SCC() {
+		if len(scc) > 1 || (len(scc) == 1 && g[scc[0]][scc[0]]) {
+			cycles = append(cycles, scc)
+		}
 	}
+	return cycles
+}
+
+// EdgeKind classifies the build.Package import list (Imports,
+// TestImports or XTestImports) that produced a given edge, so that a
+// caller can, for instance, compute a test-free reverse closure by
+// considering only Imports edges.
+type EdgeKind int
+
+const (
+	Imports EdgeKind = iota
+	TestImports
+	XTestImports
+)
+
+// importEdge is a forward edge together with the kind of import
+// list that produced it.
+type importEdge struct {
+	from, to string
+	kind     EdgeKind
+}
 
+// BuildConfig configures a scan performed by Build or a Builder. With
+// the zero value every directory named by ctxt is scanned and only
+// Imports edges are recorded; Build sets IncludeTests so that
+// TestImports and XTestImports edges are recorded too.
+type BuildConfig struct {
+	// ModuleMode, together with a non-empty Roots, restricts the
+	// packages scanned and recorded to those under Roots. The whole
+	// of ctxt is still walked to find them, and packages are located
+	// through ctxt alone: no module resolution is performed.
+	ModuleMode bool
+
+	// Roots restricts the set of packages visited to those whose
+	// import path is, or is below, one of these paths. Ignored
+	// unless ModuleMode is set.
+	Roots []string
+
+	// IncludeTests causes edges derived from TestImports and
+	// XTestImports to be recorded in addition to Imports edges. If
+	// false, only Imports edges are recorded.
+	IncludeTests bool
+
+	// Filter, if non-nil, is consulted for every package path found
+	// during the scan; paths for which it returns false are recorded
+	// neither as nodes nor as edges.
+	Filter func(path string) bool
+}
+
+func (c *BuildConfig) accept(path string) bool {
+	if c.Filter != nil && !c.Filter(path) {
+		return false
+	}
+	if c.ModuleMode && len(c.Roots) > 0 {
+		ok := false
+		for _, root := range c.Roots {
+			if path == root || strings.HasPrefix(path, root+"/") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scanPackage imports the package at path and sends its import
+// edges, classified by EdgeKind, to ch. A *build.NoGoError is not
+// reported as an error: an empty directory contributes no edges.
+func scanPackage(ctxt *build.Context, config BuildConfig, path string, ch chan<- interface{}) {
+	bp, err := ctxt.Import(path, "", 0)
+	if _, ok := err.(*build.NoGoError); ok {
+		return
+	}
+	if err != nil {
+		ch <- pathError{path, err}
+		return
+	}
+	for _, imp := range bp.Imports {
+		ch <- importEdge{path, imp, Imports}
+	}
+	if config.IncludeTests {
+		for _, imp := range bp.TestImports {
+			ch <- importEdge{path, imp, TestImports}
+		}
+		for _, imp := range bp.XTestImports {
+			ch <- importEdge{path, imp, XTestImports}
+		}
+	}
+}
+
+type pathError struct {
+	path string
+	err  error
+}
+
+// buildAll performs a full scan of ctxt according to config and
+// returns the resulting forward and reverse graphs, recording only
+// the edge kinds config asks for. Build is a thin wrapper around it.
+func buildAll(ctxt *build.Context, config BuildConfig) (forward, reverse Graph, errors map[string]error) {
 	ch := make(chan interface{})
 
 	var wg sync.WaitGroup
 	buildutil.ForEachPackage(ctxt, func(path string, err error) {
+		if !config.accept(path) {
+			return
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -75,23 +316,7 @@ func Build(ctxt *build.Context) (forward, reverse Graph, errors map[string]error
 				ch <- pathError{path, err}
 				return
 			}
-			bp, err := ctxt.Import(path, "", 0)
-			if _, ok := err.(*build.NoGoError); ok {
-				return // empty directory is not an error
-			}
-			if err != nil {
-				ch <- pathError{path, err}
-				return
-			}
-			for _, imp := range bp.Imports {
-				ch <- importEdge{path, imp}
-			}
-			for _, imp := range bp.TestImports {
-				ch <- importEdge{path, imp}
-			}
-			for _, imp := range bp.XTestImports {
-				ch <- importEdge{path, imp}
-			}
+			scanPackage(ctxt, config, path, ch)
 		}()
 	})
 	go func() {
@@ -114,6 +339,9 @@ func Build(ctxt *build.Context) (forward, reverse Graph, errors map[string]error
 			if e.to == "C" {
 				continue // "C" is fake
 			}
+			if !config.accept(e.to) {
+				continue
+			}
 			forward.addEdge(e.from, e.to)
 			reverse.addEdge(e.to, e.from)
 		}
@@ -121,3 +349,327 @@ func Build(ctxt *build.Context) (forward, reverse Graph, errors map[string]error
 
 	return forward, reverse, errors
 }
+
+// Build scans the specified Go workspace and builds the forward and
+// reverse import dependency graphs for all its packages.
+// It also returns a mapping from import paths to errors for packages
+// that could not be loaded.
+func Build(ctxt *build.Context) (forward, reverse Graph, errors map[string]error) {
+	return buildAll(ctxt, BuildConfig{IncludeTests: true})
+}
+
+// dirState is a Builder's cached scan result for one package import
+// path.
+type dirState struct {
+	modTime time.Time           // the directory's dirModTime
+	tags    string              // build tag set active when scanned
+	imports map[string]EdgeKind // edges this directory contributed, to -> kind
+	err     error
+}
+
+// A Builder incrementally maintains the forward and reverse import
+// graphs of a Go workspace. Unlike the one-shot Build function, it
+// caches the scan result of every directory it visits, keyed by the
+// directory's import path, its most recent file modification time
+// and the active build tag set, so that Update need only rescan the
+// directories an editor or language server knows (or suspects) have
+// changed, rather than the whole workspace.
+//
+// A Builder's graphs are read through Snapshot, not by reading its
+// fields directly: Update mutates them under b's lock, and a reader
+// racing a concurrent Update would otherwise hit Go's "concurrent
+// map read and map write" crash.
+type Builder struct {
+	ctxt   *build.Context
+	config BuildConfig
+
+	mu         sync.Mutex
+	dirs       map[string]dirState
+	forward    Graph
+	reverse    Graph
+	provenance map[string]map[string]EdgeKind // from -> to -> kind
+	errors     map[string]error
+}
+
+// NewBuilder creates a Builder that scans ctxt according to config.
+func NewBuilder(ctxt *build.Context, config BuildConfig) *Builder {
+	return &Builder{
+		ctxt:       ctxt,
+		config:     config,
+		dirs:       make(map[string]dirState),
+		forward:    make(Graph),
+		reverse:    make(Graph),
+		provenance: make(map[string]map[string]EdgeKind),
+		errors:     make(map[string]error),
+	}
+}
+
+// Snapshot returns a point-in-time copy of the forward and reverse
+// import graphs, their edge provenance and any per-package scan
+// errors, taken under b's lock. Use it to read a Builder's state
+// concurrently with calls to Update, e.g. from an editor or language
+// server that serves a live reverse-dependency index while file-watch
+// events drive Update in the background.
+func (b *Builder) Snapshot() (forward, reverse Graph, provenance map[string]map[string]EdgeKind, errors map[string]error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	forward = copyGraph(b.forward)
+	reverse = copyGraph(b.reverse)
+
+	provenance = make(map[string]map[string]EdgeKind, len(b.provenance))
+	for from, edges := range b.provenance {
+		m := make(map[string]EdgeKind, len(edges))
+		for to, kind := range edges {
+			m[to] = kind
+		}
+		provenance[from] = m
+	}
+
+	errors = make(map[string]error, len(b.errors))
+	for path, err := range b.errors {
+		errors[path] = err
+	}
+
+	return forward, reverse, provenance, errors
+}
+
+// copyGraph returns a deep copy of g.
+func copyGraph(g Graph) Graph {
+	cp := make(Graph, len(g))
+	for from, edges := range g {
+		e := make(map[string]bool, len(edges))
+		for to := range edges {
+			e[to] = true
+		}
+		cp[from] = e
+	}
+	return cp
+}
+
+// buildTags returns a string that changes whenever the context's
+// active build tag set does, for use in a dirState's cache key: the
+// same directory may import different packages under different tag
+// sets (GOOS, GOARCH, custom tags, cgo).
+func buildTags(ctxt *build.Context) string {
+	tags := append([]string{ctxt.GOOS, ctxt.GOARCH}, ctxt.BuildTags...)
+	if ctxt.CgoEnabled {
+		tags = append(tags, "cgo")
+	}
+	return strings.Join(tags, ",")
+}
+
+// dirModTime returns a modification time that changes whenever a
+// file in dir is added, removed or edited: the later of dir's own
+// mtime (which most filesystems bump on add/remove, but not on
+// editing an existing file in place) and the most recent mtime among
+// dir's regular files (which catches in-place edits, but not removal
+// of a file that wasn't the most recently modified one).
+func dirModTime(dir string) (time.Time, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := fi.ModTime()
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Update rescans the packages at the given import paths -- or, if
+// paths is empty, every package of b's context that b's config
+// accepts -- and applies the resulting edges to the forward and reverse
+// graphs. It returns the import paths that, as a result, entered or
+// left the set of nodes tracked by b.
+func (b *Builder) Update(paths ...string) (added, removed []string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A full rescan (no explicit paths) only visits directories that
+	// still exist, so a deleted package would otherwise never be
+	// noticed and its stale edges would live in the graphs forever;
+	// remember which paths we started with so we can diff afterwards.
+	fullScan := len(paths) == 0
+	if fullScan {
+		buildutil.ForEachPackage(b.ctxt, func(path string, err error) {
+			if err == nil && b.config.accept(path) {
+				paths = append(paths, path)
+			}
+		})
+	}
+
+	tags := buildTags(b.ctxt)
+
+	for _, path := range paths {
+		if !b.config.accept(path) {
+			continue
+		}
+
+		_, existed := b.dirs[path]
+
+		bp, berr := b.ctxt.Import(path, "", 0)
+
+		// A *build.NoGoError means the directory still exists but
+		// has no Go files; any other error might just mean the
+		// directory itself is gone, which FindOnly mode -- it does
+		// no parsing -- can tell us without being confused by a
+		// merely broken package.
+		gone := false
+		switch berr.(type) {
+		case nil:
+			// ok
+		case *build.NoGoError:
+			gone = true
+		default:
+			if _, ferr := b.ctxt.Import(path, "", build.FindOnly); ferr != nil {
+				gone = true
+			}
+		}
+		if gone {
+			b.forget(path, true)
+			if existed {
+				removed = append(removed, path)
+			}
+			continue
+		}
+
+		var mtime time.Time
+		if berr == nil {
+			if mtime, err = dirModTime(bp.Dir); err != nil {
+				return added, removed, err
+			}
+		}
+
+		if cached, ok := b.dirs[path]; ok && cached.err == nil && berr == nil &&
+			cached.tags == tags && cached.modTime.Equal(mtime) {
+			continue // nothing has changed since the last scan
+		}
+
+		b.forget(path, false)
+
+		if berr != nil {
+			b.errors[path] = berr
+			b.dirs[path] = dirState{tags: tags, err: berr}
+			if !existed {
+				added = append(added, path)
+			}
+			continue
+		}
+
+		imports := make(map[string]EdgeKind)
+		for _, imp := range bp.Imports {
+			imports[imp] = Imports
+		}
+		if b.config.IncludeTests {
+			for _, imp := range bp.TestImports {
+				if _, ok := imports[imp]; !ok {
+					imports[imp] = TestImports
+				}
+			}
+			for _, imp := range bp.XTestImports {
+				if _, ok := imports[imp]; !ok {
+					imports[imp] = XTestImports
+				}
+			}
+		}
+
+		for to, kind := range imports {
+			if to == "C" || !b.config.accept(to) {
+				delete(imports, to)
+				continue
+			}
+			b.forward.addEdge(path, to)
+			b.reverse.addEdge(to, path)
+			if b.provenance[path] == nil {
+				b.provenance[path] = make(map[string]EdgeKind)
+			}
+			b.provenance[path][to] = kind
+		}
+
+		b.dirs[path] = dirState{modTime: mtime, tags: tags, imports: imports}
+		if !existed {
+			added = append(added, path)
+		}
+	}
+
+	// On a full rescan, any cached directory that didn't turn up
+	// this time has been deleted; forget and report it too.
+	if fullScan {
+		seen := make(map[string]bool, len(paths))
+		for _, p := range paths {
+			seen[p] = true
+		}
+		for path := range b.dirs {
+			if !seen[path] {
+				b.forget(path, true)
+				removed = append(removed, path)
+			}
+		}
+	}
+
+	return added, removed, nil
+}
+
+// forget discards path's previously recorded edges and cache entry,
+// so that Update can cleanly replace them (or drop them, if path no
+// longer exists). It always removes path's outgoing edges (path -> to).
+// If deleted is set, it also removes path's incoming edges
+// (from -> path), since a deleted package must disappear from a
+// still-live importer's edge set too; otherwise a removed package
+// lingers as a phantom node in SCC/Condensation/Cycles. A package that
+// is merely rescanned keeps its importers' edges, which Update does
+// not recompute.
+func (b *Builder) forget(path string, deleted bool) {
+	state, ok := b.dirs[path]
+	if !ok {
+		return
+	}
+
+	// Remove path's outgoing edges and their matching reverse entries.
+	for to := range state.imports {
+		delete(b.forward[path], to)
+		delete(b.reverse[to], path)
+		if len(b.reverse[to]) == 0 {
+			delete(b.reverse, to)
+		}
+	}
+	if len(b.forward[path]) == 0 {
+		delete(b.forward, path)
+	}
+
+	// If path was deleted, remove its incoming edges -- every
+	// from -> path edge still held by a package that imports path --
+	// and the provenance entry each one left behind.
+	if deleted {
+		for from := range b.reverse[path] {
+			delete(b.forward[from], path)
+			if len(b.forward[from]) == 0 {
+				delete(b.forward, from)
+			}
+			if len(b.provenance[from]) > 0 {
+				delete(b.provenance[from], path)
+				if len(b.provenance[from]) == 0 {
+					delete(b.provenance, from)
+				}
+			}
+		}
+		delete(b.reverse, path)
+	}
+
+	delete(b.provenance, path)
+	delete(b.errors, path)
+	delete(b.dirs, path)
+}
@@ -0,0 +1,278 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package importgraph
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/Go-zh/tools/go/buildutil"
+)
+
+// sortedStrings returns a sorted copy of ss.
+func sortedStrings(ss []string) []string {
+	cp := append([]string(nil), ss...)
+	sort.Strings(cp)
+	return cp
+}
+
+// sortedComponents returns a copy of comps with each component sorted
+// and the components themselves sorted by their first (smallest)
+// element, so that two SCC results that differ only in iteration
+// order compare equal.
+func sortedComponents(comps [][]string) [][]string {
+	cp := make([][]string, len(comps))
+	for i, c := range comps {
+		cp[i] = sortedStrings(c)
+	}
+	sort.Slice(cp, func(i, j int) bool { return cp[i][0] < cp[j][0] })
+	return cp
+}
+
+func TestGraphSCC(t *testing.T) {
+	// a -> b -> c -> a (a cycle), c -> d (a bridge into a singleton),
+	// e -> e (a self-loop).
+	g := make(Graph)
+	g.addEdge("a", "b")
+	g.addEdge("b", "c")
+	g.addEdge("c", "a")
+	g.addEdge("c", "d")
+	g.addEdge("e", "e")
+
+	got := sortedComponents(g.SCC())
+	want := sortedComponents([][]string{{"a", "b", "c"}, {"d"}, {"e"}})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SCC() = %v, want %v", got, want)
+	}
+
+	// d is reached only as an edge target, never as a map key; it
+	// must still show up as its own singleton component.
+	found := false
+	for _, comp := range got {
+		if reflect.DeepEqual(comp, []string{"d"}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("SCC() = %v, missing singleton component for leaf node %q", got, "d")
+	}
+}
+
+func TestGraphCondensation(t *testing.T) {
+	g := make(Graph)
+	g.addEdge("a", "b")
+	g.addEdge("b", "a")
+	g.addEdge("b", "c")
+
+	cg, comp := g.Condensation()
+
+	if comp["a"] != comp["b"] {
+		t.Errorf("comp[a]=%d, comp[b]=%d, want equal (a and b are in the same SCC)", comp["a"], comp["b"])
+	}
+	if comp["a"] == comp["c"] {
+		t.Errorf("comp[a]=%d, comp[c]=%d, want different (a and c are in different SCCs)", comp["a"], comp["c"])
+	}
+
+	from := strconv.Itoa(comp["a"])
+	to := strconv.Itoa(comp["c"])
+	if !cg[from][to] {
+		t.Errorf("condensation is missing the edge %s -> %s derived from b -> c", from, to)
+	}
+}
+
+func TestGraphCycles(t *testing.T) {
+	g := make(Graph)
+	g.addEdge("a", "b")
+	g.addEdge("b", "a")
+	g.addEdge("c", "d")
+	g.addEdge("e", "e")
+
+	got := sortedComponents(g.Cycles())
+	want := sortedComponents([][]string{{"a", "b"}, {"e"}})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Cycles() = %v, want %v (c, d form no cycle and must be excluded)", got, want)
+	}
+}
+
+// TestBuildCycle is an integration test that scans a small fake
+// workspace containing a genuine import cycle and checks that Build's
+// forward and reverse graphs, fed through SCC, surface it.
+func TestBuildCycle(t *testing.T) {
+	ctxt := buildutil.FakeContext(map[string]map[string]string{
+		"a": {"a.go": `package a; import _ "b"`},
+		"b": {"b.go": `package b; import _ "c"`},
+		"c": {"c.go": `package c; import _ "a"`},
+		"d": {"d.go": `package d; import _ "a"`},
+	})
+
+	forward, reverse, errors := Build(ctxt)
+	if len(errors) != 0 {
+		t.Fatalf("Build returned errors: %v", errors)
+	}
+
+	if !forward["a"]["b"] || !forward["b"]["c"] || !forward["c"]["a"] {
+		t.Fatalf("forward graph = %v, want a->b->c->a", forward)
+	}
+	if !reverse["b"]["a"] || !reverse["a"]["c"] {
+		t.Fatalf("reverse graph = %v, want the transpose of forward", reverse)
+	}
+
+	cycles := sortedComponents(forward.Cycles())
+	want := sortedComponents([][]string{{"a", "b", "c"}})
+	if !reflect.DeepEqual(cycles, want) {
+		t.Fatalf("forward.Cycles() = %v, want %v (d must not appear: it only imports into the cycle)", cycles, want)
+	}
+}
+
+func TestBuildConfigAccept(t *testing.T) {
+	tests := []struct {
+		config BuildConfig
+		path   string
+		want   bool
+	}{
+		{BuildConfig{}, "example.com/p", true},
+		{BuildConfig{Filter: func(path string) bool { return path != "example.com/blocked" }}, "example.com/blocked", false},
+		{BuildConfig{ModuleMode: true, Roots: []string{"example.com/root"}}, "example.com/root", true},
+		{BuildConfig{ModuleMode: true, Roots: []string{"example.com/root"}}, "example.com/root/sub", true},
+		{BuildConfig{ModuleMode: true, Roots: []string{"example.com/root"}}, "example.com/other", false},
+		// ModuleMode with no Roots imposes no root restriction.
+		{BuildConfig{ModuleMode: true}, "example.com/other", true},
+	}
+	for _, test := range tests {
+		if got := test.config.accept(test.path); got != test.want {
+			t.Errorf("%+v.accept(%q) = %v, want %v", test.config, test.path, got, test.want)
+		}
+	}
+}
+
+// writeFile writes contents to name under dir, creating name's parent
+// directories as needed.
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newGOPATHContext returns a *build.Context rooted at a fresh GOPATH
+// under gopath, for tests that need Builder to observe real file
+// modification times and real deletions.
+func newGOPATHContext(gopath string) *build.Context {
+	ctxt := build.Default
+	ctxt.GOPATH = gopath
+	return &ctxt
+}
+
+// TestBuilderUpdate exercises a Builder against a real GOPATH,
+// checking that explicit Update calls pick up edits, report additions
+// and removals, and that Snapshot reflects the result.
+func TestBuilderUpdate(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "importgraph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	writeFile(t, gopath, "src/p/p.go", `package p; import _ "q"`)
+	writeFile(t, gopath, "src/q/q.go", `package q`)
+
+	b := NewBuilder(newGOPATHContext(gopath), BuildConfig{IncludeTests: true})
+
+	added, removed, err := b.Update("p", "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sortedStrings(added); !reflect.DeepEqual(got, []string{"p", "q"}) {
+		t.Fatalf("added = %v, want [p q]", got)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("removed = %v, want none", removed)
+	}
+
+	forward, _, provenance, _ := b.Snapshot()
+	if !forward["p"]["q"] {
+		t.Fatalf("forward = %v, want an edge p -> q", forward)
+	}
+	if provenance["p"]["q"] != Imports {
+		t.Fatalf("provenance[p][q] = %v, want Imports", provenance["p"]["q"])
+	}
+
+	// Rescanning with nothing changed on disk must be a cheap no-op:
+	// neither package is reported as added or removed again.
+	added, removed, err = b.Update("p", "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 || len(removed) != 0 {
+		t.Fatalf("Update on an unchanged package reported added=%v removed=%v, want none", added, removed)
+	}
+
+	// Delete q's directory entirely and rescan it explicitly: it must
+	// be reported as removed, and its edges must disappear from both
+	// graphs.
+	if err := os.RemoveAll(filepath.Join(gopath, "src/q")); err != nil {
+		t.Fatal(err)
+	}
+	added, removed, err = b.Update("q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 {
+		t.Fatalf("added = %v, want none", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"q"}) {
+		t.Fatalf("removed = %v, want [q]", removed)
+	}
+
+	forward, reverse, _, _ := b.Snapshot()
+	if forward["p"]["q"] {
+		t.Fatalf("forward = %v, still has the edge p -> q after q was deleted", forward)
+	}
+	if len(reverse["q"]) != 0 {
+		t.Fatalf("reverse[q] = %v, want none after q was deleted", reverse["q"])
+	}
+}
+
+// TestBuilderUpdateFullScanDetectsDeletion verifies that a full scan
+// (Update with no paths) notices a directory deleted since the last
+// scan even though ForEachPackage, which only walks directories that
+// still exist, never visits it.
+func TestBuilderUpdateFullScanDetectsDeletion(t *testing.T) {
+	gopath, err := ioutil.TempDir("", "importgraph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+
+	writeFile(t, gopath, "src/p/p.go", `package p`)
+	writeFile(t, gopath, "src/q/q.go", `package q`)
+
+	b := NewBuilder(newGOPATHContext(gopath), BuildConfig{IncludeTests: true})
+	if _, _, err := b.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(gopath, "src/q")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, removed, err := b.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, []string{"q"}) {
+		t.Fatalf("removed = %v, want [q] (full scan must notice q's deletion)", removed)
+	}
+}